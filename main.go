@@ -4,13 +4,18 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/ktr0731/go-fuzzyfinder"
@@ -28,6 +33,20 @@ const (
 
 var currentMode Mode = InputMode
 
+var aiModel string
+
+var aiMessages []openai.ChatCompletionMessage
+
+var aiSystemPrompt string
+
+var aiMaxTokens int
+
+var aiStop []string
+
+var debugLogPath string
+
+var lastExchange *DebugExchange
+
 type Item struct {
 	Title   string `json:"title"`
 	Link    string `json:"link"`
@@ -42,18 +61,35 @@ type ChatRequest struct {
 	Message string `json:"message"`
 }
 
+type DebugExchange struct {
+	Time       time.Time                    `json:"time"`
+	DurationMs int64                        `json:"duration_ms"`
+	Request    openai.ChatCompletionRequest `json:"request"`
+	Response   string                       `json:"response"`
+	Error      string                       `json:"error,omitempty"`
+}
+
 func main() {
 
 	envFilePtr := flag.String("envfile", ".env", "Path to the .env file")
+	modelPtr := flag.String("model", openai.GPT3Dot5Turbo, "OpenAI model to use in AI mode")
+	debugLogPtr := flag.String("debuglog", "", "Append AI requests and responses to this JSONL file")
 	flag.Parse()
 
+	aiModel = *modelPtr
+	debugLogPath = *debugLogPtr
+
 	err := godotenv.Load(*envFilePtr)
 	if err != nil {
 		log.Fatal("Error loading .env file")
 	}
+
+	aiSystemPrompt = os.Getenv("OPENAI_SYSTEM_PROMPT")
+
 	fmt.Print("===================================================\n")
 	fmt.Print("Welcome to Trm Search \n")
-	fmt.Print("Type :s to search, :ai to chat with AI, :q to quit\n")
+	fmt.Print("Type :s to search, :ai to chat with AI, :clear to reset the AI chat, :system to set the AI system prompt, :q to quit\n")
+	fmt.Print("Type :set max-tokens <n> or :set stop <sequence> to limit AI responses, :debug last to show the last AI request\n")
 	fmt.Print("===================================================\n")
 
 	for {
@@ -95,6 +131,25 @@ func handleInputMode() {
 		} else if input == ":ai" {
 			currentMode = AIMode
 			return
+		} else if input == ":clear" {
+			aiMessages = nil
+			fmt.Println("AI chat history cleared")
+		} else if input == ":system" {
+			if aiSystemPrompt == "" {
+				fmt.Println("No system prompt set")
+			} else {
+				fmt.Println("System prompt:", aiSystemPrompt)
+			}
+		} else if input == ":system-clear" {
+			aiSystemPrompt = ""
+			fmt.Println("System prompt cleared")
+		} else if strings.HasPrefix(input, ":system ") {
+			aiSystemPrompt = strings.TrimSpace(strings.TrimPrefix(input, ":system "))
+			fmt.Println("System prompt set")
+		} else if input == ":set" || strings.HasPrefix(input, ":set ") {
+			handleSetCommand(strings.TrimSpace(strings.TrimPrefix(input, ":set")))
+		} else if input == ":debug last" {
+			handleDebugLast()
 		} else if input == ":q" {
 			fmt.Println("Exiting...")
 			os.Exit(0)
@@ -104,6 +159,46 @@ func handleInputMode() {
 	}
 }
 
+func handleSetCommand(args string) {
+	name, value, _ := strings.Cut(args, " ")
+	value = strings.TrimSpace(value)
+
+	switch name {
+	case "":
+		if aiMaxTokens == 0 {
+			fmt.Println("max-tokens: model default")
+		} else {
+			fmt.Println("max-tokens:", aiMaxTokens)
+		}
+		if len(aiStop) == 0 {
+			fmt.Println("stop: none")
+		} else {
+			fmt.Printf("stop: %q\n", aiStop[0])
+		}
+	case "max-tokens":
+		maxTokens, err := strconv.Atoi(value)
+		if err != nil || maxTokens < 0 {
+			fmt.Println("Invalid max-tokens, expected a number of tokens or 0 for the model default")
+			return
+		}
+		aiMaxTokens = maxTokens
+		fmt.Println("max-tokens set")
+	case "stop":
+		if value == "" {
+			aiStop = nil
+			fmt.Println("stop sequence cleared")
+			return
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		aiStop = []string{value}
+		fmt.Println("stop sequence set")
+	default:
+		fmt.Println("Unknown setting:", name)
+	}
+}
+
 func handleSearchMode() {
 	fmt.Print("Search Query::")
 
@@ -173,25 +268,138 @@ func handleAIMode() {
 
 	reader := bufio.NewReader(os.Stdin)
 	aiPrompt, _ := reader.ReadString('\n')
+	aiPrompt = strings.TrimSpace(aiPrompt)
+
+	if aiPrompt == "" {
+		return
+	}
 
 	client := openai.NewClient(os.Getenv("OPENAI_API_KEY"))
 
-	resp, err := client.CreateChatCompletion(
-		context.Background(),
-		openai.ChatCompletionRequest{
-			Model: openai.GPT3Dot5Turbo,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: aiPrompt,
-				},
+	aiMessages = append(aiMessages, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: aiPrompt,
+	})
+
+	messages := aiMessages
+	if aiSystemPrompt != "" {
+		messages = append([]openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: aiSystemPrompt,
 			},
-		},
-	)
+		}, aiMessages...)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	request := openai.ChatCompletionRequest{
+		Model:     aiModel,
+		Messages:  messages,
+		MaxTokens: aiMaxTokens,
+		Stop:      aiStop,
+		Stream:    true,
+	}
+
+	var reply strings.Builder
+
+	exchange := DebugExchange{Time: time.Now(), Request: request}
+	exchange.Request.Messages = append([]openai.ChatCompletionMessage(nil), messages...)
+	defer func() {
+		exchange.DurationMs = time.Since(exchange.Time).Milliseconds()
+		exchange.Response = reply.String()
+		recordExchange(exchange)
+	}()
+
+	stream, err := client.CreateChatCompletionStream(ctx, request)
 
 	if err != nil {
-		log.Fatal(err)
+		exchange.Error = err.Error()
+		aiMessages = aiMessages[:len(aiMessages)-1]
+		if ctx.Err() != nil {
+			fmt.Println("\nGeneration cancelled")
+			return
+		}
+		fmt.Println("Error from AI:", err)
+
+		var apiErr *openai.APIError
+		if errors.As(err, &apiErr) && apiErr.Code == "context_length_exceeded" {
+			fmt.Println("The conversation is too long for the model, type :clear to start a new one")
+		}
+		return
+	}
+
+	defer stream.Close()
+
+	fmt.Print("ChatCompletion response: ")
+
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			fmt.Println()
+			break
+		}
+
+		if err != nil {
+			exchange.Error = err.Error()
+			if ctx.Err() != nil {
+				fmt.Println("\nGeneration cancelled")
+				break
+			}
+			aiMessages = aiMessages[:len(aiMessages)-1]
+			fmt.Println("\nError from AI:", err)
+			return
+		}
+
+		if len(resp.Choices) > 0 {
+			fmt.Print(resp.Choices[0].Delta.Content)
+			reply.WriteString(resp.Choices[0].Delta.Content)
+		}
+	}
+
+	if reply.Len() == 0 {
+		aiMessages = aiMessages[:len(aiMessages)-1]
+		return
+	}
+
+	aiMessages = append(aiMessages, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleAssistant,
+		Content: reply.String(),
+	})
+}
+
+func recordExchange(exchange DebugExchange) {
+	lastExchange = &exchange
+
+	if debugLogPath == "" {
+		return
+	}
+
+	file, err := os.OpenFile(debugLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Println("Error opening debug log:", err)
+		return
+	}
+	defer file.Close()
+
+	err = json.NewEncoder(file).Encode(exchange)
+	if err != nil {
+		fmt.Println("Error writing debug log:", err)
+	}
+}
+
+func handleDebugLast() {
+	if lastExchange == nil {
+		fmt.Println("No AI exchange recorded yet")
+		return
+	}
+
+	out, err := json.MarshalIndent(lastExchange, "", "  ")
+	if err != nil {
+		fmt.Println("Error formatting exchange:", err)
+		return
 	}
 
-	fmt.Printf("ChatCompletion response: %v\n", resp.Choices[0].Message.Content)
+	fmt.Println(string(out))
 }